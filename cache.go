@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CacheEntry is a fully serialized response, ready to be replayed without
+// round-tripping to the responder on stdin.
+type CacheEntry struct {
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Trailer http.Header `json:"trailer"`
+	Body    []byte      `json:"body"`
+	Expires time.Time   `json:"expires"`
+}
+
+func (e *CacheEntry) expired(now time.Time) bool {
+	return now.After(e.Expires)
+}
+
+// response reconstructs a Response from a cache entry for a given
+// request, so it can be written out and logged the same way a live
+// responder's reply is.
+func (e *CacheEntry) response(requestID uuid.UUID) *Response {
+	return &Response{
+		Status:    e.Status,
+		Header:    e.Header,
+		Trailer:   e.Trailer,
+		Body:      e.Body,
+		RequestID: requestID,
+	}
+}
+
+// CacheEvent is emitted as http.cache.hit/http.cache.miss so scripts can
+// observe cache behavior.
+type CacheEvent struct {
+	RequestID uuid.UUID `json:"request_id"`
+	Key       string    `json:"key"`
+}
+
+// ResponseCache is an in-memory, optionally disk-backed cache of
+// responses, keyed on method + request URI + the header values named in
+// Vary. It sits between the HTTP handler and ResponseWaiters: a hit is
+// served directly, skipping stdin entirely.
+type ResponseCache struct {
+	Vary       []string
+	MaxEntries int
+	MaxBytes   int
+	DefaultTTL time.Duration
+	Dir        string
+
+	mu      sync.Mutex
+	entries map[string]*CacheEntry
+	order   []string // insertion order, oldest first, for eviction
+	bytes   int
+}
+
+func NewResponseCache(vary []string, maxEntries, maxBytes int, defaultTTL time.Duration, dir string) *ResponseCache {
+	c := &ResponseCache{
+		Vary:       vary,
+		MaxEntries: maxEntries,
+		MaxBytes:   maxBytes,
+		DefaultTTL: defaultTTL,
+		Dir:        dir,
+		entries:    make(map[string]*CacheEntry),
+	}
+	if dir != "" {
+		c.load()
+	}
+	return c
+}
+
+// Key computes the cache key for r from its method, request URI, and the
+// values of the configured Vary headers.
+func (c *ResponseCache) Key(r *http.Request) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(r.RequestURI))
+	for _, name := range c.Vary {
+		h.Write([]byte{0})
+		h.Write([]byte(name))
+		h.Write([]byte{'='})
+		h.Write([]byte(strings.Join(r.Header.Values(name), ",")))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *ResponseCache) Get(key string) (*CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if entry.expired(time.Now()) {
+		c.removeLocked(key)
+		return nil, false
+	}
+	return entry, true
+}
+
+// Put stores response under key with the given ttl, falling back to
+// DefaultTTL. A non-positive ttl (after the fallback) means the response
+// isn't cacheable, so Put is a no-op.
+func (c *ResponseCache) Put(key string, response *Response, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = c.DefaultTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	entry := &CacheEntry{
+		Status:  response.Status,
+		Header:  response.Header,
+		Trailer: response.Trailer,
+		Body:    response.Body,
+		Expires: time.Now().Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.entries[key]; ok {
+		c.bytes -= len(old.Body)
+	} else {
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = entry
+	c.bytes += len(entry.Body)
+	c.evictLocked()
+
+	if c.Dir != "" {
+		c.saveLocked(key, entry)
+	}
+}
+
+func (c *ResponseCache) evictLocked() {
+	for (c.MaxEntries > 0 && len(c.entries) > c.MaxEntries) || (c.MaxBytes > 0 && c.bytes > c.MaxBytes) {
+		if len(c.order) == 0 {
+			break
+		}
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		c.removeLocked(oldest)
+	}
+}
+
+func (c *ResponseCache) removeLocked(key string) {
+	if entry, ok := c.entries[key]; ok {
+		c.bytes -= len(entry.Body)
+		delete(c.entries, key)
+	}
+	if c.Dir != "" {
+		os.Remove(c.path(key))
+	}
+}
+
+func (c *ResponseCache) path(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+func (c *ResponseCache) saveLocked(key string, entry *CacheEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	os.MkdirAll(c.Dir, 0o755)
+	os.WriteFile(c.path(key), data, 0o644)
+}
+
+func (c *ResponseCache) load() {
+	files, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(c.Dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		entry := new(CacheEntry)
+		if err := json.Unmarshal(data, entry); err != nil {
+			continue
+		}
+		if entry.expired(now) {
+			os.Remove(filepath.Join(c.Dir, f.Name()))
+			continue
+		}
+
+		key := strings.TrimSuffix(f.Name(), ".json")
+		c.entries[key] = entry
+		c.order = append(c.order, key)
+		c.bytes += len(entry.Body)
+	}
+}
+
+// cacheTTL reports how long response should be cached for: an explicit
+// CacheTTL takes priority, falling back to a Cache-Control: max-age=N
+// header. A zero result means the response didn't ask to be cached.
+func cacheTTL(response *Response) time.Duration {
+	if response.CacheTTL != nil {
+		return time.Duration(*response.CacheTTL) * time.Second
+	}
+
+	for _, directive := range strings.Split(response.Header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if n, ok := strings.CutPrefix(directive, "max-age="); ok {
+			if seconds, err := strconv.Atoi(n); err == nil {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return 0
+}
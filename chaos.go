@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"path"
+	"time"
+)
+
+// ChaosRule describes one fault to inject: requests whose method and path
+// match the given globs are, with the given probability, subjected to
+// Action.
+type ChaosRule struct {
+	Method      string  `json:"method,omitempty"` // glob, e.g. "GET"; empty or "*" matches any
+	Path        string  `json:"path,omitempty"`   // glob, e.g. "/flaky/*"; empty or "*" matches any
+	Probability float64 `json:"probability"`
+
+	// Action is one of "drop", "delay", "corrupt" or "5xx".
+	Action string `json:"action"`
+
+	// Delay is the (minimum, if DelayMax is set) duration a "delay" rule
+	// sleeps before writing the response.
+	Delay    string `json:"delay,omitempty"`
+	DelayMax string `json:"delay_max,omitempty"`
+
+	// Status is the code a "5xx" rule responds with; defaults to 500.
+	Status int `json:"status,omitempty"`
+}
+
+func (rule *ChaosRule) matches(r *http.Request) bool {
+	if rule.Method != "" && rule.Method != "*" {
+		if ok, _ := path.Match(rule.Method, r.Method); !ok {
+			return false
+		}
+	}
+	if rule.Path != "" && rule.Path != "*" {
+		if ok, _ := path.Match(rule.Path, r.URL.Path); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// sampleDelay returns rule.Delay, or a uniformly sampled duration in
+// [Delay, DelayMax) when DelayMax is also set.
+func (rule *ChaosRule) sampleDelay() time.Duration {
+	min, _ := time.ParseDuration(rule.Delay)
+	if rule.DelayMax == "" {
+		return min
+	}
+	max, err := time.ParseDuration(rule.DelayMax)
+	if err != nil || max <= min {
+		return min
+	}
+	return min + time.Duration(rand.Int63n(int64(max-min)))
+}
+
+// ChaosConfig is a small declarative ruleset for fault injection, loaded
+// from a flag or env var as a JSON array of ChaosRule.
+type ChaosConfig struct {
+	Rules []ChaosRule
+}
+
+func loadChaosConfig(raw string) (*ChaosConfig, error) {
+	cfg := &ChaosConfig{}
+	if raw == "" {
+		return cfg, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &cfg.Rules); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// pick returns the first rule matching r whose probability roll
+// succeeds, or nil if none fires.
+func (cfg *ChaosConfig) pick(r *http.Request) *ChaosRule {
+	for i := range cfg.Rules {
+		rule := &cfg.Rules[i]
+		if rule.matches(r) && rand.Float64() < rule.Probability {
+			return rule
+		}
+	}
+	return nil
+}
+
+// corruptBody flips bits through body so a client that checksums or
+// parses the response sees damaged data, without changing its length.
+func corruptBody(body []byte) []byte {
+	corrupted := append([]byte(nil), body...)
+	for i := 0; i < len(corrupted); i += 7 {
+		corrupted[i] ^= 0xff
+	}
+	return corrupted
+}
@@ -3,61 +3,199 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// requestChunkSize is the size of each http.request.chunk frame emitted
+// while streaming a request body.
+const requestChunkSize = 32 * 1024
+
 type Request struct {
 	Method     string      `json:"method"`
 	Header     http.Header `json:"header"`
 	RemoteAddr string      `json:"remote_addr"`
 	RequestURI string      `json:"uri"`
-	Body       []byte      `json:"body"`
+	Body       []byte      `json:"body,omitempty"`
 	RequestID  uuid.UUID   `json:"request_id"`
+	Streaming  bool        `json:"streaming,omitempty"`
+}
+
+// RequestChunk carries a slice of a streamed request body. Frames are
+// emitted in order and terminated by a RequestEnd for the same RequestID.
+type RequestChunk struct {
+	RequestID uuid.UUID `json:"request_id"`
+	Data      []byte    `json:"data"`
+}
+
+type RequestEnd struct {
+	RequestID uuid.UUID `json:"request_id"`
 }
 
 type Response struct {
-	Body      []byte    `json:"body"`
+	Status    int         `json:"status,omitempty"`
+	Header    http.Header `json:"header,omitempty"`
+	Trailer   http.Header `json:"trailer,omitempty"`
+	Body      []byte      `json:"body"`
+	RequestID uuid.UUID   `json:"request_id"`
+
+	// CacheTTL, in seconds, tells the response cache how long to store
+	// this response for. A Cache-Control: max-age=N header is honored if
+	// CacheTTL is unset.
+	CacheTTL *int `json:"cache_ttl,omitempty"`
+}
+
+// writeTo writes the response's status, headers, trailer and body to w,
+// defaulting to a 200 with no headers for backward compatibility.
+func (resp *Response) writeTo(w http.ResponseWriter) {
+	header := w.Header()
+	for k, v := range resp.Header {
+		header[k] = v
+	}
+
+	for k := range resp.Trailer {
+		header.Add("Trailer", k)
+	}
+
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+
+	w.Write(resp.Body)
+
+	for k, v := range resp.Trailer {
+		header[k] = v
+	}
+}
+
+// ResponseChunk carries a slice of a streamed response body, written to
+// stdin by the responder in place of (or in addition to, for the tail) a
+// full Response.
+type ResponseChunk struct {
+	RequestID uuid.UUID `json:"request_id"`
+	Data      []byte    `json:"data"`
+}
+
+type ResponseEnd struct {
 	RequestID uuid.UUID `json:"request_id"`
 }
 
+// responseFrame is the unit of work handed to a request's waiter channel.
+// Exactly one of response, chunk or end is set: a full, single-shot
+// Response, a body chunk to flush, or the terminator for a chunked
+// response.
+type responseFrame struct {
+	response *Response
+	chunk    []byte
+	end      bool
+}
+
+// waiter is a single request's receiver: a buffered channel of frames,
+// plus a done channel that cancel closes. Without done, a deliver that
+// finds the waiter still registered could block forever sending into an
+// abandoned channel if the handler had already given up and stopped
+// receiving (e.g. a timeout racing a chunk).
+type waiter struct {
+	frames chan *responseFrame
+	done   chan struct{}
+}
+
+// ResponseWaiters is a registry of per-request writers: each waiting
+// handler owns a channel of responseFrame that the stdin reader feeds as
+// frames for its request_id arrive.
 type ResponseWaiters struct {
-	waiters map[uuid.UUID]chan *Response
+	waiters map[uuid.UUID]*waiter
 	sync.Mutex
 }
 
 func NewResponseWaiters() *ResponseWaiters {
-	return &ResponseWaiters{waiters: make(map[uuid.UUID]chan *Response)}
+	return &ResponseWaiters{waiters: make(map[uuid.UUID]*waiter)}
 }
 
-func (r *ResponseWaiters) Get(request_id uuid.UUID) *Response {
-	c := make(chan *Response)
+// register inserts a waiter for request_id under the lock and returns its
+// frame channel. It must be called before the request is emitted, so a
+// responder that writes to stdin before the caller starts receiving
+// still finds the waiter in place. The channel is buffered by one so a
+// concurrent deliver never blocks holding the map lock.
+func (r *ResponseWaiters) register(request_id uuid.UUID) chan *responseFrame {
+	w := &waiter{frames: make(chan *responseFrame, 1), done: make(chan struct{})}
 	r.Lock()
-	r.waiters[request_id] = c
+	r.waiters[request_id] = w
 	r.Unlock()
-	return <-c
+	return w.frames
 }
 
-func (r *ResponseWaiters) Respond(request_id uuid.UUID, response *Response) {
+// deliver sends frame to the waiter for request_id. final must be true for
+// a full Response or a ResponseEnd, since those close out the request; it
+// is false for a chunk, which leaves the waiter registered for more
+// frames. If the waiter has been cancelled, deliver gives up on the send
+// instead of blocking on a reader that will never come back.
+func (r *ResponseWaiters) deliver(request_id uuid.UUID, frame *responseFrame, final bool) {
 	r.Lock()
-	defer r.Unlock()
-	if c, ok := r.waiters[request_id]; ok {
+	w, ok := r.waiters[request_id]
+	if ok && final {
 		delete(r.waiters, request_id)
-		c <- response
+	}
+	r.Unlock()
+
+	if !ok {
+		emitPacket("http.response.log", &ResponseLog{
+			Err:      "unknown request",
+			Response: frame.response,
+		})
 		return
 	}
-	emitPacket("http.response.log", &ResponseLog{
-		Err:      "unknown request",
-		Response: response,
-	})
+
+	select {
+	case w.frames <- frame:
+	case <-w.done:
+		emitPacket("http.response.log", &ResponseLog{
+			Err:      "unknown request",
+			Response: frame.response,
+		})
+	}
+}
+
+func (r *ResponseWaiters) Respond(response *Response) {
+	r.deliver(response.RequestID, &responseFrame{response: response}, true)
+}
+
+func (r *ResponseWaiters) RespondChunk(chunk *ResponseChunk) {
+	r.deliver(chunk.RequestID, &responseFrame{chunk: chunk.Data}, false)
+}
+
+func (r *ResponseWaiters) RespondEnd(end *ResponseEnd) {
+	r.deliver(end.RequestID, &responseFrame{end: true}, true)
+}
+
+// cancel removes the waiter for request_id and wakes up any deliver that
+// is (or will be) blocked sending to it, so a responder arriving after
+// the request has already timed out is logged as "unknown request"
+// instead of deadlocking the stdin reader.
+func (r *ResponseWaiters) cancel(request_id uuid.UUID) {
+	r.Lock()
+	w, ok := r.waiters[request_id]
+	if ok {
+		delete(r.waiters, request_id)
+	}
+	r.Unlock()
+
+	if ok {
+		close(w.done)
+	}
 }
 
 type ResponseLog struct {
@@ -65,6 +203,9 @@ type ResponseLog struct {
 	Took     float64   `json:"took,omitempty"`
 	Response *Response `json:"response,omitempty"`
 	Raw      []byte    `json:"raw,omitempty"`
+	// Injected marks a response that chaos mode tampered with or
+	// fabricated, rather than one that round-tripped to the responder.
+	Injected bool `json:"injected,omitempty"`
 }
 
 type Packet struct {
@@ -77,63 +218,357 @@ func emitPacket(app string, content interface{}) {
 	json.NewEncoder(os.Stdout).Encode(packet)
 }
 
-func main() {
-	responses := NewResponseWaiters()
+// inPacket mirrors Packet for decoding lines read from stdin. The "app"
+// field is optional: a bare Response with no envelope is still accepted,
+// so existing line-delimited responders keep working unchanged.
+type inPacket struct {
+	App     string          `json:"app"`
+	Content json.RawMessage `json:"content"`
+}
+
+func readResponses(r io.Reader, responses *ResponseWaiters) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+
+		var envelope inPacket
+		if err := json.Unmarshal(line, &envelope); err != nil {
+			emitPacket("http.response.log", &ResponseLog{
+				Err: fmt.Sprintf("malformed: %s ", err),
+				Raw: append([]byte(nil), line...),
+			})
+			continue
+		}
+
+		content := envelope.Content
+		if content == nil {
+			content = line
+		}
 
-	go func() {
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
+		switch envelope.App {
+		case "http.response.chunk":
+			chunk := new(ResponseChunk)
+			if err := json.Unmarshal(content, chunk); err != nil {
+				emitPacket("http.response.log", &ResponseLog{
+					Err: fmt.Sprintf("malformed: %s ", err),
+					Raw: append([]byte(nil), line...),
+				})
+				continue
+			}
+			responses.RespondChunk(chunk)
+		case "http.response.end":
+			end := new(ResponseEnd)
+			if err := json.Unmarshal(content, end); err != nil {
+				emitPacket("http.response.log", &ResponseLog{
+					Err: fmt.Sprintf("malformed: %s ", err),
+					Raw: append([]byte(nil), line...),
+				})
+				continue
+			}
+			responses.RespondEnd(end)
+		default:
 			response := new(Response)
-			err := json.Unmarshal(scanner.Bytes(), response)
-			if err != nil {
+			if err := json.Unmarshal(content, response); err != nil {
 				emitPacket("http.response.log", &ResponseLog{
 					Err: fmt.Sprintf("malformed: %s ", err),
-					Raw: scanner.Bytes(),
+					Raw: append([]byte(nil), line...),
 				})
 				continue
 			}
-			responses.Respond(response.RequestID, response)
+			responses.Respond(response)
 		}
-		if err := scanner.Err(); err != nil {
-			panic(err)
+	}
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+}
+
+// responseDeadlineSlack is how far ahead of the server's WriteTimeout the
+// per-request deadline fires, so the 504 below has time to be fully
+// buffered and flushed before the connection is cut.
+const responseDeadlineSlack = 1 * time.Second
+
+// requestDeadline derives the per-request wait from the server's
+// WriteTimeout. A WriteTimeout of zero means "no timeout", so requests
+// wait for a responder indefinitely.
+func requestDeadline(writeTimeout time.Duration) time.Duration {
+	if writeTimeout <= 0 {
+		return 0
+	}
+	if d := writeTimeout - responseDeadlineSlack; d > 0 {
+		return d
+	}
+	return writeTimeout
+}
+
+// writeGatewayTimeout writes a deterministic 504 with an explicit
+// Content-Length so the response is never chunked, and can't be delayed
+// by compression.
+func writeGatewayTimeout(w http.ResponseWriter) {
+	body := []byte("Gateway Timeout\n")
+	header := w.Header()
+	header.Del("Content-Encoding")
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusGatewayTimeout)
+	w.Write(body)
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if s := os.Getenv(key); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			return d
 		}
-	}()
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if s := os.Getenv(key); s != "" {
+		if n, err := strconv.Atoi(s); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// streamRequestBody emits body as a sequence of http.request.chunk
+// packets followed by a terminating http.request.end, both keyed by
+// requestID.
+func streamRequestBody(requestID uuid.UUID, body io.Reader) {
+	buf := make([]byte, requestChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			emitPacket("http.request.chunk", &RequestChunk{RequestID: requestID, Data: data})
+		}
+		if err != nil {
+			break
+		}
+	}
+	emitPacket("http.request.end", &RequestEnd{RequestID: requestID})
+}
+
+func main() {
+	stream := flag.Bool("stream", os.Getenv("HTTP_SH_STREAM") != "", "stream request/response bodies as chunked packets instead of buffering them whole")
+	readHeaderTimeout := flag.Duration("read-header-timeout", envDuration("HTTP_SH_READ_HEADER_TIMEOUT", 5*time.Second), "http.Server ReadHeaderTimeout")
+	readTimeout := flag.Duration("read-timeout", envDuration("HTTP_SH_READ_TIMEOUT", 0), "http.Server ReadTimeout")
+	writeTimeout := flag.Duration("write-timeout", envDuration("HTTP_SH_WRITE_TIMEOUT", 30*time.Second), "http.Server WriteTimeout; also bounds how long a request waits for a responder")
+	idleTimeout := flag.Duration("idle-timeout", envDuration("HTTP_SH_IDLE_TIMEOUT", 0), "http.Server IdleTimeout")
+	cacheVary := flag.String("cache-vary", os.Getenv("HTTP_SH_CACHE_VARY"), "comma-separated request header names that vary the cache key")
+	cacheMaxEntries := flag.Int("cache-max-entries", envInt("HTTP_SH_CACHE_MAX_ENTRIES", 0), "maximum number of cached responses (0 = unlimited)")
+	cacheMaxBytes := flag.Int("cache-max-bytes", envInt("HTTP_SH_CACHE_MAX_BYTES", 0), "maximum total bytes of cached response bodies (0 = unlimited)")
+	cacheDefaultTTL := flag.Duration("cache-default-ttl", envDuration("HTTP_SH_CACHE_DEFAULT_TTL", 0), "cache TTL to use when a response doesn't specify its own")
+	cacheDir := flag.String("cache-dir", os.Getenv("HTTP_SH_CACHE_DIR"), "optional directory to persist cache entries on disk")
+	chaos := flag.Bool("chaos", os.Getenv("HTTP_SH_CHAOS") != "", "enable chaos mode: inject faults per -chaos-rules to exercise client retry logic")
+	chaosRules := flag.String("chaos-rules", os.Getenv("HTTP_SH_CHAOS_RULES"), `JSON array of chaos rules: [{"method","path","probability","action","delay","delay_max","status"}]`)
+	flag.Parse()
+
+	var vary []string
+	for _, name := range strings.Split(*cacheVary, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			vary = append(vary, name)
+		}
+	}
+	cache := NewResponseCache(vary, *cacheMaxEntries, *cacheMaxBytes, *cacheDefaultTTL, *cacheDir)
+
+	chaosConfig := &ChaosConfig{}
+	if *chaos {
+		var err error
+		chaosConfig, err = loadChaosConfig(*chaosRules)
+		if err != nil {
+			log.Fatalf("-chaos-rules: %s", err)
+		}
+	}
+
+	responses := NewResponseWaiters()
+
+	go readResponses(os.Stdin, responses)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 
 		start := time.Now()
 
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			panic(err)
+		requestID := uuid.New()
+
+		var chaosDelay time.Duration
+		var chaosCorrupt bool
+		if rule := chaosConfig.pick(r); rule != nil {
+			switch rule.Action {
+			case "drop":
+				// never emit the request, and never write a response: block
+				// until the client gives up or the server's WriteTimeout
+				// aborts the connection, so the client actually sees a
+				// timeout rather than an empty 200.
+				emitPacket("http.response.log", &ResponseLog{Err: "chaos: dropped", Injected: true})
+				if d := requestDeadline(*writeTimeout); d > 0 {
+					timer := time.NewTimer(d)
+					defer timer.Stop()
+					select {
+					case <-r.Context().Done():
+					case <-timer.C:
+					}
+				} else {
+					<-r.Context().Done()
+				}
+				return
+			case "5xx":
+				status := rule.Status
+				if status == 0 {
+					status = http.StatusInternalServerError
+				}
+				response := &Response{Status: status, Body: []byte("chaos: injected failure\n"), RequestID: requestID}
+				response.writeTo(w)
+				took := math.Round(float64(time.Since(start))/float64(time.Millisecond)*10) / 10
+				emitPacket("http.response.log", &ResponseLog{Response: response, Took: took, Injected: true})
+				return
+			case "delay":
+				chaosDelay, chaosCorrupt = rule.sampleDelay(), false
+			case "corrupt":
+				chaosCorrupt = true
+			}
 		}
 
-		requestID := uuid.New()
+		// chaos is resolved before the cache is consulted, and applied to
+		// cache hits too: a chaos rule would otherwise be silently
+		// bypassed for any request a warm cache answers. The cache itself
+		// only ever stores the pristine entry.response below, so a
+		// "corrupt" rule never poisons what later, non-chaos clients get
+		// served from a hit.
+		cacheKey := cache.Key(r)
+		if entry, ok := cache.Get(cacheKey); ok {
+			emitPacket("http.cache.hit", &CacheEvent{RequestID: requestID, Key: cacheKey})
+			response := entry.response(requestID)
+			served := response
+			if chaosDelay > 0 {
+				time.Sleep(chaosDelay)
+			}
+			if chaosCorrupt {
+				corrupted := *response
+				corrupted.Body = corruptBody(response.Body)
+				served = &corrupted
+			}
+			served.writeTo(w)
+			took := math.Round(float64(time.Since(start))/float64(time.Millisecond)*10) / 10
+			emitPacket("http.response.log", &ResponseLog{Response: served, Took: took, Injected: chaosDelay > 0 || chaosCorrupt})
+			return
+		}
+		emitPacket("http.cache.miss", &CacheEvent{RequestID: requestID, Key: cacheKey})
+
 		req := &Request{
 			Method:     r.Method,
 			Header:     r.Header,
 			RemoteAddr: r.RemoteAddr,
 			RequestURI: r.RequestURI,
-			Body:       body,
 			RequestID:  requestID,
+			Streaming:  *stream,
+		}
+
+		if !*stream {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				panic(err)
+			}
+			req.Body = body
 		}
 
-		// there's an almost impossible race condition here. if a responder can
-		// write to STDIN fast enough so a response is received before
-		// `responses.Get` is called, the response will be thrown away as an
-		// "unknown request"
+		// register the waiter before emitting the request, so a responder
+		// that writes to stdin before we start receiving can't have its
+		// response thrown away as an "unknown request"
+		c := responses.register(requestID)
 		emitPacket("http.request", req)
-		response := responses.Get(requestID)
 
-		w.Write(response.Body)
+		// reading r.Body after ServeHTTP returns is undefined, so the
+		// handler waits for this goroutine (below, after the response is
+		// written) instead of letting it outlive the deferred Body.Close.
+		var streamDone chan struct{}
+		if *stream {
+			streamDone = make(chan struct{})
+			go func() {
+				defer close(streamDone)
+				streamRequestBody(requestID, r.Body)
+			}()
+		}
+
+		var timeout <-chan time.Time
+		if d := requestDeadline(*writeTimeout); d > 0 {
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		var response *Response
+		timedOut := false
+		wroteChunk := false
+	wait:
+		for {
+			select {
+			case frame := <-c:
+				if frame.chunk != nil {
+					wroteChunk = true
+					w.Write(frame.chunk)
+					if f, ok := w.(http.Flusher); ok {
+						f.Flush()
+					}
+					continue
+				}
+				if frame.response != nil {
+					response = frame.response
+					// cache the responder's original response before chaos
+					// has a chance to corrupt it below.
+					if ttl := cacheTTL(response); ttl > 0 {
+						cache.Put(cacheKey, response, ttl)
+					}
+
+					served := response
+					if chaosDelay > 0 {
+						time.Sleep(chaosDelay)
+					}
+					if chaosCorrupt {
+						corrupted := *response
+						corrupted.Body = corruptBody(response.Body)
+						served = &corrupted
+					}
+					served.writeTo(w)
+					response = served
+				}
+				break wait
+			case <-timeout:
+				responses.cancel(requestID)
+				// once a chunk has been flushed, the status line is already
+				// on the wire: there's no well-formed 504 to write, so just
+				// let the connection die at the server's WriteTimeout.
+				if !wroteChunk {
+					writeGatewayTimeout(w)
+				}
+				timedOut = true
+				break wait
+			}
+		}
 
 		took := math.Round(float64(time.Since(start))/float64(time.Millisecond)*10) / 10
-		emitPacket("http.response.log", &ResponseLog{
-			Response: response,
-			Took:     took,
-		})
+		logEntry := &ResponseLog{Took: took, Injected: chaosDelay > 0 || chaosCorrupt}
+		if timedOut {
+			logEntry.Err = "timeout"
+		} else {
+			logEntry.Response = response
+		}
+		emitPacket("http.response.log", logEntry)
+
+		if streamDone != nil {
+			<-streamDone
+		}
 	})
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	server := &http.Server{
+		Addr:              ":8080",
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	log.Fatal(server.ListenAndServe())
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A responder writing to stdin immediately after a waiter is registered
+// (even concurrently, before the handler starts receiving) must still be
+// delivered rather than dropped as "unknown request". register is called
+// before the request is emitted for exactly this reason.
+func TestResponseWaitersRegisterBeforeDeliver(t *testing.T) {
+	responses := NewResponseWaiters()
+	requestID := uuid.New()
+
+	c := responses.register(requestID)
+
+	done := make(chan struct{})
+	go func() {
+		responses.Respond(&Response{RequestID: requestID, Body: []byte("ok")})
+		close(done)
+	}()
+
+	select {
+	case frame := <-c:
+		if frame.response == nil || string(frame.response.Body) != "ok" {
+			t.Fatalf("unexpected frame: %+v", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("deliver blocked instead of using the buffered channel")
+	}
+
+	<-done
+}
+
+// cancel must wake up a deliver that's blocked sending to an abandoned
+// waiter, rather than leaving it to block forever.
+func TestResponseWaitersCancelUnblocksDeliver(t *testing.T) {
+	responses := NewResponseWaiters()
+	requestID := uuid.New()
+
+	responses.register(requestID)
+	responses.cancel(requestID)
+
+	done := make(chan struct{})
+	go func() {
+		responses.Respond(&Response{RequestID: requestID, Body: []byte("late")})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("deliver blocked after the waiter was cancelled")
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	if d := requestDeadline(0); d != 0 {
+		t.Fatalf("requestDeadline(0) = %v, want 0 (no timeout configured)", d)
+	}
+	if d := requestDeadline(30 * time.Second); d != 30*time.Second-responseDeadlineSlack {
+		t.Fatalf("requestDeadline(30s) = %v, want %v", d, 30*time.Second-responseDeadlineSlack)
+	}
+	if d := requestDeadline(500 * time.Millisecond); d != 500*time.Millisecond {
+		t.Fatalf("requestDeadline(500ms) = %v, want 500ms unchanged (slack would go negative)", d)
+	}
+}
+
+// The timeout response must be a deterministic, fully-buffered 504: an
+// explicit Content-Length, no chunked transfer-encoding, no compression.
+func TestWriteGatewayTimeout(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeGatewayTimeout(rec)
+
+	if rec.Code != 504 {
+		t.Fatalf("status = %d, want 504", rec.Code)
+	}
+	if got, want := rec.Header().Get("Content-Length"), strconv.Itoa(rec.Body.Len()); got != want {
+		t.Fatalf("Content-Length = %q, want %q", got, want)
+	}
+	if rec.Header().Get("Transfer-Encoding") != "" {
+		t.Fatalf("Transfer-Encoding = %q, want unset", rec.Header().Get("Transfer-Encoding"))
+	}
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("Content-Encoding = %q, want unset", rec.Header().Get("Content-Encoding"))
+	}
+}